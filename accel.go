@@ -0,0 +1,56 @@
+package virtuakube
+
+import "runtime"
+
+// An Accelerator selects the hardware virtualization backend qemu
+// uses to run a VM.
+type Accelerator int
+
+const (
+	// AccelAuto picks a sensible accelerator for the host platform,
+	// based on runtime.GOOS. This is the default.
+	AccelAuto Accelerator = iota
+	// AccelKVM uses Linux's KVM.
+	AccelKVM
+	// AccelHVF uses macOS's Hypervisor.framework.
+	AccelHVF
+	// AccelWHPX uses the Windows Hypervisor Platform.
+	AccelWHPX
+	// AccelTCG uses qemu's software emulator. This works everywhere
+	// but is drastically slower than a hardware accelerator.
+	AccelTCG
+)
+
+// String returns the qemu "-accel" value for a.
+func (a Accelerator) String() string {
+	switch a {
+	case AccelKVM:
+		return "kvm"
+	case AccelHVF:
+		return "hvf"
+	case AccelWHPX:
+		return "whpx"
+	case AccelTCG:
+		return "tcg"
+	default:
+		return "auto"
+	}
+}
+
+// resolve returns a concrete accelerator for a, detecting one from
+// the host platform if a is AccelAuto.
+func (a Accelerator) resolve() Accelerator {
+	if a != AccelAuto {
+		return a
+	}
+	switch runtime.GOOS {
+	case "linux":
+		return AccelKVM
+	case "darwin":
+		return AccelHVF
+	case "windows":
+		return AccelWHPX
+	default:
+		return AccelTCG
+	}
+}
@@ -0,0 +1,99 @@
+package virtuakube
+
+import "fmt"
+
+// A ClusterConfig describes a cluster of VMs to create within a
+// Universe.
+type ClusterConfig struct {
+	// Name identifies the cluster within its universe, and is used
+	// as a prefix for its VMs' hostnames.
+	Name string
+	// NumNodes is the number of worker nodes to create in addition
+	// to the cluster's master.
+	NumNodes int
+	// VMConfig is the configuration used to create each of the
+	// cluster's VMs.
+	VMConfig *VMConfig
+	// NetworkAddon names the Kubernetes network addon for the
+	// cluster, e.g. "calico". Start does not read or install it.
+	NetworkAddon string
+	// Network is the network the cluster's VMs are attached to, in
+	// addition to any networks already listed in VMConfig.Networks.
+	// Defaults to the universe's default network.
+	Network *Network
+}
+
+// A Cluster is a set of VMs within a Universe, a master plus worker
+// nodes, booted together on a shared Network. Start boots the VMs
+// only; it does not set up Kubernetes on them.
+type Cluster struct {
+	universe *Universe
+	cfg      *ClusterConfig
+	network  *Network
+
+	master *VM
+	nodes  []*VM
+
+	snapshots map[string]bool
+}
+
+// NewCluster registers a new cluster within the universe. Call Start
+// to create and boot its VMs.
+func (u *Universe) NewCluster(cfg *ClusterConfig) (*Cluster, error) {
+	if cfg.Name == "" {
+		return nil, fmt.Errorf("cluster config needs a Name")
+	}
+	if cfg.VMConfig == nil {
+		return nil, fmt.Errorf("cluster config needs a VMConfig")
+	}
+
+	network := cfg.Network
+	if network == nil {
+		network = u.defaultNetwork
+	}
+
+	return &Cluster{
+		universe: u,
+		cfg:      cfg,
+		network:  network,
+	}, nil
+}
+
+// Start creates and boots the cluster's VMs: one master, plus
+// cfg.NumNodes workers, all attached to the cluster's Network.
+func (c *Cluster) Start() error {
+	vmCfg := *c.cfg.VMConfig
+	vmCfg.Networks = append([]*Network{c.network}, vmCfg.Networks...)
+
+	master, err := c.universe.NewVM(c.cfg.Name+"-master", &vmCfg)
+	if err != nil {
+		return fmt.Errorf("creating master: %v", err)
+	}
+	c.master = master
+
+	for i := 0; i < c.cfg.NumNodes; i++ {
+		node, err := c.universe.NewVM(fmt.Sprintf("%s-node%d", c.cfg.Name, i), &vmCfg)
+		if err != nil {
+			return fmt.Errorf("creating node %d: %v", i, err)
+		}
+		c.nodes = append(c.nodes, node)
+	}
+
+	return nil
+}
+
+// Master returns the cluster's master VM.
+func (c *Cluster) Master() *VM {
+	return c.master
+}
+
+// Nodes returns the cluster's worker VMs.
+func (c *Cluster) Nodes() []*VM {
+	return c.nodes
+}
+
+// vms returns every VM belonging to the cluster: its master plus all
+// of its nodes.
+func (c *Cluster) vms() []*VM {
+	return append([]*VM{c.master}, c.nodes...)
+}
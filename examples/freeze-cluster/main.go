@@ -12,16 +12,32 @@ import (
 )
 
 var (
-	dir          = flag.String("universe-dir", "", "directory in which to place the universe")
 	baseImg      = flag.String("vm-img", "virtuakube.qcow2", "VM base image")
 	memory       = flag.Int("memory", 1024, "amount of memory per VM, in MiB")
 	nodes        = flag.Int("nodes", 1, "number of worker nodes in addition to master")
 	display      = flag.Bool("display", false, "create display windows for each VM")
 	networkAddon = flag.String("network-addon", "calico", "network addon to install")
 	verbose      = flag.Bool("verbose", false, "show commands being executed during cluster startup")
-	kvm          = flag.Bool("kvm", true, "use KVM hardware acceleration")
+	accel        = flag.String("accel", "auto", "acceleration backend to use (auto, kvm, hvf, whpx, tcg)")
 )
 
+func parseAccelerator(s string) (virtuakube.Accelerator, error) {
+	switch s {
+	case "auto":
+		return virtuakube.AccelAuto, nil
+	case "kvm":
+		return virtuakube.AccelKVM, nil
+	case "hvf":
+		return virtuakube.AccelHVF, nil
+	case "whpx":
+		return virtuakube.AccelWHPX, nil
+	case "tcg":
+		return virtuakube.AccelTCG, nil
+	default:
+		return virtuakube.AccelAuto, fmt.Errorf("unknown accelerator %q", s)
+	}
+}
+
 func main() {
 	flag.Parse()
 
@@ -34,18 +50,6 @@ func main() {
 func run() error {
 	start := time.Now()
 
-	if *dir == "" {
-		return fmt.Errorf("-universe-dir is required (but will be created if non-existent")
-	}
-
-	cmd := virtuakube.Open
-	_, err := os.Stat(*dir)
-	if os.IsNotExist(err) {
-		cmd = virtuakube.Create
-	} else if err != nil {
-		return err
-	}
-
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
 
@@ -63,19 +67,24 @@ func run() error {
 
 	fmt.Println("Creating universe...")
 
-	universe, err := cmd(ctx, *dir)
+	universe, err := virtuakube.New(ctx)
 	if err != nil {
-		return fmt.Errorf("Creating universe: %v", err)
+		return fmt.Errorf("creating universe: %v", err)
 	}
 	defer universe.Close()
 
+	accelerator, err := parseAccelerator(*accel)
+	if err != nil {
+		return err
+	}
+
 	cfg := &virtuakube.ClusterConfig{
 		Name:     "freeze-example",
 		NumNodes: *nodes,
 		VMConfig: &virtuakube.VMConfig{
-			Image:     *baseImg,
-			MemoryMiB: *memory,
-			NoKVM:     !*kvm,
+			Image:       *baseImg,
+			MemoryMiB:   *memory,
+			Accelerator: accelerator,
 		},
 		NetworkAddon: *networkAddon,
 	}
@@ -93,13 +102,13 @@ func run() error {
 		return fmt.Errorf("starting cluster: %v", err)
 	}
 
-	fmt.Println("Freezing universe...")
+	fmt.Println("Freezing cluster...")
 
-	if err := universe.Save(); err != nil {
-		return fmt.Errorf("saving universe: %v", err)
+	if err := cluster.Snapshot("freeze-example"); err != nil {
+		return fmt.Errorf("snapshotting cluster: %v", err)
 	}
 
-	fmt.Printf("Universe saved in %s. Use examples/thaw-universe to restore.\n", time.Since(start).Truncate(time.Second))
+	fmt.Printf("Cluster snapshotted in %s. The snapshot is removed with the universe when this program exits.\n", time.Since(start).Truncate(time.Second))
 
 	return nil
 }
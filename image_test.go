@@ -0,0 +1,135 @@
+package virtuakube
+
+import (
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestCachedMetaMatches(t *testing.T) {
+	dir := t.TempDir()
+	metaPath := filepath.Join(dir, "image.meta")
+
+	if cachedMetaMatches(metaPath, imageCacheMeta{ETag: `"abc"`}) {
+		t.Fatal("expected no match before a meta sidecar exists")
+	}
+
+	if err := writeImageCacheMeta(metaPath, imageCacheMeta{ETag: `"abc"`}); err != nil {
+		t.Fatalf("writeImageCacheMeta: %v", err)
+	}
+
+	if !cachedMetaMatches(metaPath, imageCacheMeta{ETag: `"abc"`}) {
+		t.Error("expected match on identical ETag")
+	}
+	if cachedMetaMatches(metaPath, imageCacheMeta{ETag: `"def"`}) {
+		t.Error("expected no match on changed ETag")
+	}
+
+	// With no ETag in play, falls back to Last-Modified.
+	if err := writeImageCacheMeta(metaPath, imageCacheMeta{LastModified: "Mon, 01 Jan 2024 00:00:00 GMT"}); err != nil {
+		t.Fatalf("writeImageCacheMeta: %v", err)
+	}
+	if !cachedMetaMatches(metaPath, imageCacheMeta{LastModified: "Mon, 01 Jan 2024 00:00:00 GMT"}) {
+		t.Error("expected match on identical Last-Modified")
+	}
+	if cachedMetaMatches(metaPath, imageCacheMeta{LastModified: "Tue, 02 Jan 2024 00:00:00 GMT"}) {
+		t.Error("expected no match on changed Last-Modified")
+	}
+}
+
+func TestFileSHA256Matches(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "disk.qcow2")
+	if err := os.WriteFile(path, []byte("hello"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	const helloSHA256 = "2cf24dba5fb0a30e26e83b2ac5b9e29e1b161e5c1fa7425e73043362938b9824"
+
+	if ok, err := fileSHA256Matches(path, helloSHA256); err != nil || !ok {
+		t.Errorf("fileSHA256Matches(correct sum) = (%v, %v), want (true, nil)", ok, err)
+	}
+	if ok, err := fileSHA256Matches(path, "0000000000000000000000000000000000000000000000000000000000000"); err != nil || ok {
+		t.Errorf("fileSHA256Matches(wrong sum) = (%v, %v), want (false, nil)", ok, err)
+	}
+	if ok, err := fileSHA256Matches(filepath.Join(dir, "missing.qcow2"), helloSHA256); err != nil || ok {
+		t.Errorf("fileSHA256Matches(missing file) = (%v, %v), want (false, nil)", ok, err)
+	}
+}
+
+func TestAcquireImageLockSerializes(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "image.qcow2")
+
+	lock, err := acquireImageLock(dst)
+	if err != nil {
+		t.Fatalf("acquireImageLock: %v", err)
+	}
+
+	acquired := make(chan struct{})
+	go func() {
+		lock2, err := acquireImageLock(dst)
+		if err != nil {
+			t.Errorf("second acquireImageLock: %v", err)
+			return
+		}
+		close(acquired)
+		releaseImageLock(lock2)
+	}()
+
+	select {
+	case <-acquired:
+		t.Fatal("second acquireImageLock returned while the first lock was still held")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	releaseImageLock(lock)
+
+	select {
+	case <-acquired:
+	case <-time.After(time.Second):
+		t.Fatal("second acquireImageLock never returned after the first lock was released")
+	}
+}
+
+func TestAcquireImageLockConcurrent(t *testing.T) {
+	dir := t.TempDir()
+	dst := filepath.Join(dir, "image.qcow2")
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var holders int
+	var maxHolders int
+
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			lock, err := acquireImageLock(dst)
+			if err != nil {
+				t.Errorf("acquireImageLock: %v", err)
+				return
+			}
+			mu.Lock()
+			holders++
+			if holders > maxHolders {
+				maxHolders = holders
+			}
+			mu.Unlock()
+
+			time.Sleep(time.Millisecond)
+
+			mu.Lock()
+			holders--
+			mu.Unlock()
+			releaseImageLock(lock)
+		}()
+	}
+	wg.Wait()
+
+	if maxHolders != 1 {
+		t.Errorf("max concurrent lock holders = %d, want 1", maxHolders)
+	}
+}
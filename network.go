@@ -0,0 +1,139 @@
+package virtuakube
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"time"
+)
+
+// netemTools are the extra host tools needed to shim a VM's network
+// through a tap device we can apply tc qdiscs to, rather than
+// connecting it directly to the vde switch.
+var netemTools = []string{
+	"ip",
+	"tc",
+	"vde_plug",
+}
+
+// netemState tracks the fault-injection modifiers currently applied
+// to a NIC. AddDelay/AddLoss/AddDuplication/AddPartition all share a
+// single root netem qdisc on the tap device, so each one updates its
+// share of the state and rebuilds the whole qdisc and filter set
+// rather than clobbering whatever the others installed.
+type netemState struct {
+	delay            time.Duration
+	jitter           time.Duration
+	lossPercent      float64
+	duplicatePercent float64
+	partitioned      []net.HardwareAddr
+}
+
+// AddDelay adds delay (with optional +/- jitter) to all traffic
+// leaving vm's primary NIC.
+func (u *Universe) AddDelay(vm *VM, delay, jitter time.Duration) error {
+	nic := vm.primaryNIC()
+	nic.netem.delay = delay
+	nic.netem.jitter = jitter
+	return applyNetem(u, nic)
+}
+
+// AddLoss randomly drops lossPercent of traffic leaving vm's primary
+// NIC.
+func (u *Universe) AddLoss(vm *VM, lossPercent float64) error {
+	nic := vm.primaryNIC()
+	nic.netem.lossPercent = lossPercent
+	return applyNetem(u, nic)
+}
+
+// AddDuplication randomly duplicates duplicatePercent of traffic
+// leaving vm's primary NIC.
+func (u *Universe) AddDuplication(vm *VM, duplicatePercent float64) error {
+	nic := vm.primaryNIC()
+	nic.netem.duplicatePercent = duplicatePercent
+	return applyNetem(u, nic)
+}
+
+// AddPartition drops all traffic between a and b's primary NICs, in
+// both directions, while leaving their other connectivity intact.
+func (u *Universe) AddPartition(a, b *VM) error {
+	if err := addPartitionPeer(u, a, b.primaryNIC().mac); err != nil {
+		return err
+	}
+	return addPartitionPeer(u, b, a.primaryNIC().mac)
+}
+
+func addPartitionPeer(u *Universe, from *VM, peer net.HardwareAddr) error {
+	nic := from.primaryNIC()
+	for _, p := range nic.netem.partitioned {
+		if p.String() == peer.String() {
+			return nil
+		}
+	}
+	nic.netem.partitioned = append(nic.netem.partitioned, peer)
+	return applyNetem(u, nic)
+}
+
+// applyNetem rebuilds nic's root netem qdisc and drop filters from
+// its current netemState. tc has no way to patch a single modifier
+// in place, so the whole qdisc (and, since replacing the root qdisc
+// drops anything attached to it, the partition filters too) is
+// reinstalled on every call.
+func applyNetem(u *Universe, nic *vmNIC) error {
+	args := []string{"qdisc", "replace", "dev", nic.tapName, "root", "handle", "1:", "netem"}
+	if nic.netem.delay > 0 {
+		args = append(args, "delay", nic.netem.delay.String())
+		if nic.netem.jitter > 0 {
+			args = append(args, nic.netem.jitter.String())
+		}
+	}
+	if nic.netem.lossPercent > 0 {
+		args = append(args, "loss", fmt.Sprintf("%.2f%%", nic.netem.lossPercent))
+	}
+	if nic.netem.duplicatePercent > 0 {
+		args = append(args, "duplicate", fmt.Sprintf("%.2f%%", nic.netem.duplicatePercent))
+	}
+	if err := runTC(u, args); err != nil {
+		return err
+	}
+
+	for _, peer := range nic.netem.partitioned {
+		if err := runTC(u, dropTrafficToArgs(nic.tapName, peer)); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// dropTrafficToArgs builds the tc arguments for a u32 filter that
+// drops frames addressed to peer's MAC. It matches the destination
+// address as two word-aligned chunks (the first 4 bytes, then the
+// next 2, with the 2 bytes that follow them masked off) since tc-u32
+// has no dedicated Ethernet-address match keyword.
+func dropTrafficToArgs(tapName string, peer net.HardwareAddr) []string {
+	hi := fmt.Sprintf("0x%02x%02x%02x%02x", peer[0], peer[1], peer[2], peer[3])
+	lo := fmt.Sprintf("0x%02x%02x0000", peer[4], peer[5])
+	return []string{
+		"filter", "add", "dev", tapName, "parent", "1:",
+		"protocol", "all", "u32",
+		"match", "u32", hi, "0xffffffff", "at", "0",
+		"match", "u32", lo, "0xffff0000", "at", "4",
+		"action", "drop",
+	}
+}
+
+// Clear removes all delay, loss, duplication and partition rules
+// previously applied to vm's primary NIC.
+func (u *Universe) Clear(vm *VM) error {
+	nic := vm.primaryNIC()
+	nic.netem = netemState{}
+	return runTC(u, []string{"qdisc", "del", "dev", nic.tapName, "root"})
+}
+
+func runTC(u *Universe, args []string) error {
+	cmd := exec.CommandContext(u.ctx, "tc", args...)
+	if out, err := cmd.CombinedOutput(); err != nil {
+		return fmt.Errorf("tc %v: %v: %s", args, err, out)
+	}
+	return nil
+}
@@ -0,0 +1,24 @@
+package virtuakube
+
+import (
+	"net"
+	"reflect"
+	"testing"
+)
+
+func TestDropTrafficToArgs(t *testing.T) {
+	peer := net.HardwareAddr{0x00, 0x11, 0x22, 0x33, 0x44, 0x55}
+
+	got := dropTrafficToArgs("tap0", peer)
+	want := []string{
+		"filter", "add", "dev", "tap0", "parent", "1:",
+		"protocol", "all", "u32",
+		"match", "u32", "0x00112233", "0xffffffff", "at", "0",
+		"match", "u32", "0x44550000", "0xffff0000", "at", "4",
+		"action", "drop",
+	}
+
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("dropTrafficToArgs(%v) = %v, want %v", peer, got, want)
+	}
+}
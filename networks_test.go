@@ -0,0 +1,42 @@
+package virtuakube
+
+import (
+	"net"
+	"testing"
+)
+
+func TestIncrementIPCarries(t *testing.T) {
+	ip := net.IPv4(10, 0, 0, 255).To4()
+	incrementIP(ip)
+	if !ip.Equal(net.IPv4(10, 0, 1, 0)) {
+		t.Errorf("incrementIP(10.0.0.255) = %v, want 10.0.1.0", ip)
+	}
+}
+
+func TestNetworkIPv4ExhaustsPool(t *testing.T) {
+	_, ip4net, err := net.ParseCIDR("10.0.0.0/30")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := &Network{
+		name:    "test",
+		ip4net:  ip4net,
+		nextIP4: net.IPv4(10, 0, 0, 1).To4(),
+	}
+
+	// 10.0.0.0/30 usable non-network addresses: .1, .2, .3 (the
+	// allocator doesn't reserve a broadcast address).
+	for _, want := range []string{"10.0.0.1", "10.0.0.2", "10.0.0.3"} {
+		got, err := n.ipv4()
+		if err != nil {
+			t.Fatalf("ipv4() for %s: unexpected error: %v", want, err)
+		}
+		if got.String() != want {
+			t.Errorf("ipv4() = %s, want %s", got, want)
+		}
+	}
+
+	if _, err := n.ipv4(); err == nil {
+		t.Error("expected an error once the pool is exhausted, got nil")
+	}
+}
@@ -0,0 +1,115 @@
+package virtuakube
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+)
+
+// qmpConn is a minimal client for QEMU's QMP JSON monitor protocol,
+// connected over the unix socket each VM is launched with via
+// "-qmp unix:...,server,nowait".
+type qmpConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+// dialQMP connects to the QMP socket at sock and completes the
+// capabilities handshake QEMU requires before accepting commands.
+func dialQMP(sock string) (*qmpConn, error) {
+	conn, err := net.Dial("unix", sock)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to QMP socket: %v", err)
+	}
+
+	q := &qmpConn{
+		conn: conn,
+		r:    bufio.NewReader(conn),
+	}
+
+	// QEMU greets us with a banner describing itself, which we don't
+	// need but must read before negotiating capabilities.
+	if _, err := q.readResponse(); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("reading QMP greeting: %v", err)
+	}
+
+	if _, err := q.execute("qmp_capabilities", nil); err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("negotiating QMP capabilities: %v", err)
+	}
+
+	return q, nil
+}
+
+func (q *qmpConn) Close() error {
+	return q.conn.Close()
+}
+
+// execute sends a QMP command and returns its "return" field.
+func (q *qmpConn) execute(cmd string, args map[string]interface{}) (json.RawMessage, error) {
+	req := map[string]interface{}{
+		"execute": cmd,
+	}
+	if args != nil {
+		req["arguments"] = args
+	}
+
+	enc := json.NewEncoder(q.conn)
+	if err := enc.Encode(req); err != nil {
+		return nil, fmt.Errorf("sending QMP command %q: %v", cmd, err)
+	}
+
+	return q.readResponse()
+}
+
+// humanCommand runs a legacy human monitor command (e.g. "savevm
+// tag") via QMP's human-monitor-command passthrough, for
+// functionality that has no dedicated QMP verb.
+func (q *qmpConn) humanCommand(line string) (string, error) {
+	raw, err := q.execute("human-monitor-command", map[string]interface{}{
+		"command-line": line,
+	})
+	if err != nil {
+		return "", err
+	}
+	var out string
+	if err := json.Unmarshal(raw, &out); err != nil {
+		return "", fmt.Errorf("decoding human-monitor-command reply: %v", err)
+	}
+	return out, nil
+}
+
+// readResponse reads QMP messages until it finds one that is a
+// command reply (as opposed to an asynchronous event), and returns
+// its "return" payload.
+func (q *qmpConn) readResponse() (json.RawMessage, error) {
+	for {
+		line, err := q.r.ReadBytes('\n')
+		if err != nil {
+			return nil, err
+		}
+
+		var msg struct {
+			Return json.RawMessage `json:"return"`
+			Error  *struct {
+				Class string `json:"class"`
+				Desc  string `json:"desc"`
+			} `json:"error"`
+			Event string `json:"event"`
+		}
+		if err := json.Unmarshal(line, &msg); err != nil {
+			return nil, fmt.Errorf("decoding QMP message: %v", err)
+		}
+
+		if msg.Event != "" {
+			// Not a command reply, keep reading.
+			continue
+		}
+		if msg.Error != nil {
+			return nil, fmt.Errorf("QMP error (%s): %s", msg.Error.Class, msg.Error.Desc)
+		}
+		return msg.Return, nil
+	}
+}
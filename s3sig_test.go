@@ -0,0 +1,53 @@
+package virtuakube
+
+import (
+	"net/http"
+	"testing"
+)
+
+func TestSignS3RequestMethodBound(t *testing.T) {
+	cfg := &VMConfig{
+		Image:              "s3://example-bucket/images/base.qcow2",
+		AWSAccessKeyID:     "AKIDEXAMPLE",
+		AWSSecretAccessKey: "secret",
+	}
+
+	sign := func(method string) string {
+		req, err := http.NewRequest(method, "https://example-bucket.s3.us-east-1.amazonaws.com/images/base.qcow2", nil)
+		if err != nil {
+			t.Fatalf("building %s request: %v", method, err)
+		}
+		if err := signS3Request(req, "us-east-1", cfg); err != nil {
+			t.Fatalf("signing %s request: %v", method, err)
+		}
+		return req.Header.Get("Authorization")
+	}
+
+	headSig := sign(http.MethodHead)
+	getSig := sign(http.MethodGet)
+
+	if headSig == "" || getSig == "" {
+		t.Fatal("expected non-empty Authorization headers")
+	}
+	if headSig == getSig {
+		t.Fatal("HEAD and GET requests got the same signature; SigV4 signatures must be bound to the request method")
+	}
+}
+
+func TestCanonicalizeHeaders(t *testing.T) {
+	header := http.Header{}
+	header.Set("X-Amz-Date", "20210101T000000Z")
+	header.Set("Host", "example-bucket.s3.us-east-1.amazonaws.com")
+
+	signedHeaders, canonical := canonicalizeHeaders(header)
+
+	const wantSigned = "host;x-amz-date"
+	if signedHeaders != wantSigned {
+		t.Errorf("signedHeaders = %q, want %q", signedHeaders, wantSigned)
+	}
+
+	const wantCanonical = "host:example-bucket.s3.us-east-1.amazonaws.com\nx-amz-date:20210101T000000Z\n"
+	if canonical != wantCanonical {
+		t.Errorf("canonicalHeaders = %q, want %q", canonical, wantCanonical)
+	}
+}
@@ -0,0 +1,244 @@
+package virtuakube
+
+import (
+	"fmt"
+	"strings"
+)
+
+// unsnapshottableDeviceMarkers are qemu command-line fragments that
+// indicate a VM has a device attached whose state lives outside the
+// qcow2 disk (e.g. a host-shared directory), and so can't be
+// faithfully captured by savevm/loadvm.
+var unsnapshottableDeviceMarkers = []string{
+	"9p",
+	"vvfat",
+}
+
+// Snapshot saves the current RAM and device state of every VM in the
+// universe into their respective qcow2 disk images, tagged with tag.
+// All VMs are paused for the duration of the snapshot so that the
+// saved state is consistent across the whole universe, then resumed.
+//
+// To snapshot only the VMs belonging to one cluster, use
+// Cluster.Snapshot instead.
+//
+// Snapshot fails if any VM has a non-snapshottable device attached,
+// such as a shared 9p or vvfat mount, since qemu cannot capture that
+// state.
+func (u *Universe) Snapshot(tag string) error {
+	vms := make([]*VM, 0, len(u.vms))
+	for _, vm := range u.vms {
+		vms = append(vms, vm)
+	}
+	if err := snapshotVMs(vms, tag); err != nil {
+		return err
+	}
+
+	u.closeMu.Lock()
+	defer u.closeMu.Unlock()
+	if u.snapshots == nil {
+		u.snapshots = map[string]bool{}
+	}
+	u.snapshots[tag] = true
+
+	return nil
+}
+
+// RestoreSnapshot restores every VM in the universe to the RAM and
+// device state previously saved under tag with Snapshot.
+func (u *Universe) RestoreSnapshot(tag string) error {
+	if !u.hasSnapshot(tag) {
+		return fmt.Errorf("no such snapshot %q", tag)
+	}
+
+	vms := make([]*VM, 0, len(u.vms))
+	for _, vm := range u.vms {
+		vms = append(vms, vm)
+	}
+	return restoreVMs(vms, tag)
+}
+
+// ListSnapshots returns the tags of all whole-universe snapshots
+// taken with Snapshot so far.
+func (u *Universe) ListSnapshots() []string {
+	u.closeMu.Lock()
+	defer u.closeMu.Unlock()
+
+	ret := make([]string, 0, len(u.snapshots))
+	for tag := range u.snapshots {
+		ret = append(ret, tag)
+	}
+	return ret
+}
+
+// DeleteSnapshot removes the universe-wide snapshot tagged tag from
+// every VM's disk image.
+func (u *Universe) DeleteSnapshot(tag string) error {
+	if !u.hasSnapshot(tag) {
+		return fmt.Errorf("no such snapshot %q", tag)
+	}
+
+	vms := make([]*VM, 0, len(u.vms))
+	for _, vm := range u.vms {
+		vms = append(vms, vm)
+	}
+	if err := deleteVMsSnapshot(vms, tag); err != nil {
+		return err
+	}
+
+	u.closeMu.Lock()
+	defer u.closeMu.Unlock()
+	delete(u.snapshots, tag)
+
+	return nil
+}
+
+func (u *Universe) hasSnapshot(tag string) bool {
+	u.closeMu.Lock()
+	defer u.closeMu.Unlock()
+	return u.snapshots[tag]
+}
+
+// Snapshot saves the current RAM and device state of every VM in the
+// cluster (master and nodes) into their respective qcow2 disk
+// images, tagged with tag. All of the cluster's VMs are paused for
+// the duration of the snapshot so the saved state is consistent
+// across the cluster, then resumed.
+//
+// Snapshot fails if any of the cluster's VMs has a non-snapshottable
+// device attached, such as a shared 9p or vvfat mount.
+func (c *Cluster) Snapshot(tag string) error {
+	if err := snapshotVMs(c.vms(), tag); err != nil {
+		return err
+	}
+
+	if c.snapshots == nil {
+		c.snapshots = map[string]bool{}
+	}
+	c.snapshots[tag] = true
+
+	return nil
+}
+
+// RestoreSnapshot restores every VM in the cluster to the RAM and
+// device state previously saved under tag with Snapshot.
+func (c *Cluster) RestoreSnapshot(tag string) error {
+	if !c.snapshots[tag] {
+		return fmt.Errorf("no such snapshot %q", tag)
+	}
+	return restoreVMs(c.vms(), tag)
+}
+
+// ListSnapshots returns the tags of all snapshots taken of this
+// cluster so far.
+func (c *Cluster) ListSnapshots() []string {
+	ret := make([]string, 0, len(c.snapshots))
+	for tag := range c.snapshots {
+		ret = append(ret, tag)
+	}
+	return ret
+}
+
+// DeleteSnapshot removes the snapshot tagged tag from the disk image
+// of every VM in the cluster.
+func (c *Cluster) DeleteSnapshot(tag string) error {
+	if !c.snapshots[tag] {
+		return fmt.Errorf("no such snapshot %q", tag)
+	}
+	if err := deleteVMsSnapshot(c.vms(), tag); err != nil {
+		return err
+	}
+	delete(c.snapshots, tag)
+	return nil
+}
+
+// snapshotVMs pauses every vm, saves tag into each of their disk
+// images, and resumes them all again.
+func snapshotVMs(vms []*VM, tag string) error {
+	for _, vm := range vms {
+		if err := vm.checkSnapshottable(); err != nil {
+			return err
+		}
+	}
+
+	return withPausedVMs(vms, func(vm *VM, mon *Monitor) error {
+		if _, err := mon.HumanCommand("savevm " + tag); err != nil {
+			return fmt.Errorf("snapshotting %s: %v", vm.hostname, err)
+		}
+		return nil
+	})
+}
+
+// restoreVMs restores every vm to the state saved under tag.
+func restoreVMs(vms []*VM, tag string) error {
+	return withPausedVMs(vms, func(vm *VM, mon *Monitor) error {
+		if _, err := mon.HumanCommand("loadvm " + tag); err != nil {
+			return fmt.Errorf("restoring %s to snapshot %q: %v", vm.hostname, tag, err)
+		}
+		return nil
+	})
+}
+
+// deleteVMsSnapshot removes the snapshot tagged tag from every vm's
+// disk image.
+func deleteVMsSnapshot(vms []*VM, tag string) error {
+	for _, vm := range vms {
+		mon, err := vm.Monitor()
+		if err != nil {
+			return fmt.Errorf("connecting to %s: %v", vm.hostname, err)
+		}
+		_, err = mon.HumanCommand("delvm " + tag)
+		mon.Close()
+		if err != nil {
+			return fmt.Errorf("deleting snapshot %q on %s: %v", tag, vm.hostname, err)
+		}
+	}
+	return nil
+}
+
+// withPausedVMs pauses every vm, runs fn against each one's monitor
+// connection, and resumes all of them again regardless of whether fn
+// succeeded.
+func withPausedVMs(vms []*VM, fn func(vm *VM, mon *Monitor) error) error {
+	mons := map[*VM]*Monitor{}
+	defer func() {
+		for _, mon := range mons {
+			mon.HumanCommand("cont")
+			mon.Close()
+		}
+	}()
+
+	for _, vm := range vms {
+		mon, err := vm.Monitor()
+		if err != nil {
+			return fmt.Errorf("connecting to %s: %v", vm.hostname, err)
+		}
+		mons[vm] = mon
+		if _, err := mon.HumanCommand("stop"); err != nil {
+			return fmt.Errorf("pausing %s: %v", vm.hostname, err)
+		}
+	}
+
+	for vm, mon := range mons {
+		if err := fn(vm, mon); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// checkSnapshottable returns an error if the VM has a device attached
+// whose state can't be captured by qemu's savevm.
+func (v *VM) checkSnapshottable() error {
+	if v.cmd == nil {
+		return nil
+	}
+	args := strings.Join(v.cmd.Args, " ")
+	for _, marker := range unsnapshottableDeviceMarkers {
+		if strings.Contains(args, marker) {
+			return fmt.Errorf("%s has a non-snapshottable device attached (%s), cannot snapshot", v.hostname, marker)
+		}
+	}
+	return nil
+}
@@ -5,17 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
-	"net"
 	"os"
 	"os/exec"
-	"path/filepath"
 	"strings"
 	"sync"
 )
 
+// universeTools are the tools a universe always needs, regardless of
+// which qemu binary individual VMs end up using.
 var universeTools = []string{
 	"vde_switch",
-	"qemu-system-x86_64",
 	"qemu-img",
 }
 
@@ -45,18 +44,39 @@ type Universe struct {
 	ctx      context.Context
 	shutdown context.CancelFunc
 	ports    chan int
-	nextIP4  net.IP
-	nextIP6  net.IP
 	vms      map[string]*VM
 
-	swtch *exec.Cmd
-	sock  string
+	networks       map[string]*Network
+	defaultNetwork *Network
+
+	snapshots map[string]bool
+
+	tapMu sync.Mutex
+	taps  []string
 
 	closeMu  sync.Mutex
 	closed   bool
 	closeErr error
 }
 
+// trackTap records a host tap device as belonging to the universe,
+// so Close can remove it. Tap devices created by newTapShim outlive
+// the processes attached to them and are never cleaned up by the
+// kernel on its own.
+func (u *Universe) trackTap(name string) {
+	u.tapMu.Lock()
+	defer u.tapMu.Unlock()
+	u.taps = append(u.taps, name)
+}
+
+// defaultV4CIDR and defaultV6CIDR are the ranges used for the
+// universe's default network, i.e. the one VMs attach to when
+// VMConfig.Networks is empty.
+const (
+	defaultV4CIDR = "172.20.0.0/16"
+	defaultV6CIDR = "fd00::/64"
+)
+
 // New creates a new virtual universe. The ctx controls the overall
 // lifetime of the universe, i.e. if the context is canceled or times
 // out, the universe will be destroyed.
@@ -72,35 +92,22 @@ func New(ctx context.Context) (*Universe, error) {
 
 	ctx, shutdown := context.WithCancel(ctx)
 
-	sock := filepath.Join(p, "switch")
-
 	ret := &Universe{
 		tmpdir:   p,
 		ctx:      ctx,
 		shutdown: shutdown,
 		ports:    make(chan int),
-		nextIP4:  net.ParseIP("172.20.0.1").To4(),
-		nextIP6:  net.ParseIP("fd00::1"),
 		vms:      map[string]*VM{},
-		swtch: exec.CommandContext(
-			ctx,
-			"vde_switch",
-			"--sock", sock,
-			"-m", "0600",
-		),
-		sock: sock,
+		networks: map[string]*Network{},
 	}
 
-	if err := ret.swtch.Start(); err != nil {
+	defNet, err := ret.NewNetwork("default", defaultV4CIDR, defaultV6CIDR)
+	if err != nil {
 		ret.Close()
 		return nil, err
 	}
-	// Destroy the universe if the virtual switch exits
-	go func() {
-		ret.swtch.Wait()
-		// TODO: logging and stuff
-		ret.Close()
-	}()
+	ret.defaultNetwork = defNet
+
 	// Destroy the universe if the parent context cancels
 	go func() {
 		<-ctx.Done()
@@ -150,7 +157,21 @@ func (u *Universe) Close() error {
 
 	u.shutdown()
 
-	u.closeErr = os.RemoveAll(u.tmpdir)
+	var errs []error
+	u.tapMu.Lock()
+	for _, tap := range u.taps {
+		del := exec.Command("ip", "tuntap", "del", "dev", tap, "mode", "tap")
+		if out, err := del.CombinedOutput(); err != nil {
+			errs = append(errs, fmt.Errorf("deleting tap %s: %v: %s", tap, err, out))
+		}
+	}
+	u.tapMu.Unlock()
+
+	if err := os.RemoveAll(u.tmpdir); err != nil {
+		errs = append(errs, err)
+	}
+
+	u.closeErr = errors.Join(errs...)
 	return u.closeErr
 }
 
@@ -168,22 +189,8 @@ func (u *Universe) VM(hostname string) *VM {
 	return u.vms[hostname]
 }
 
-func (u *Universe) switchSock() string {
-	return u.sock
-}
-
-func (u *Universe) ipv4() net.IP {
-	ret := u.nextIP4
-	u.nextIP4 = make(net.IP, 4)
-	copy(u.nextIP4, ret)
-	u.nextIP4[3]++
-	return ret
-}
-
-func (u *Universe) ipv6() net.IP {
-	ret := u.nextIP6
-	u.nextIP6 = make(net.IP, 16)
-	copy(u.nextIP6, ret)
-	u.nextIP6[15]++
-	return ret
+// Network returns the named network previously created with
+// NewNetwork, or nil if there is no such network.
+func (u *Universe) Network(name string) *Network {
+	return u.networks[name]
 }
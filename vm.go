@@ -0,0 +1,361 @@
+package virtuakube
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+)
+
+// A VMConfig describes how to construct a VM.
+type VMConfig struct {
+	// Image is the path to the qcow2 disk image to boot the VM
+	// from. The image is not modified, a copy-on-write overlay is
+	// created for the VM to write to instead.
+	//
+	// Image may also be an http(s):// or s3:// URL, in which case it
+	// is downloaded into a local cache keyed by ImageSHA256 and
+	// reused across VMs and universes.
+	Image string
+	// ImageSHA256 is the expected SHA-256 of Image, hex-encoded.
+	// Required when Image is a URL, used to validate the download
+	// and as the cache key.
+	ImageSHA256 string
+	// ImageCacheDir overrides where downloaded images are cached.
+	// Defaults to a subdirectory of the universe's Tmpdir.
+	ImageCacheDir string
+	// AWSAccessKeyID, AWSSecretAccessKey and AWSSessionToken are
+	// used to sign requests for Image URLs in private s3:// buckets.
+	// Leave unset to fetch from a public bucket.
+	AWSAccessKeyID     string
+	AWSSecretAccessKey string
+	AWSSessionToken    string
+	// AWSRegion is the region of the s3:// bucket referenced by
+	// Image, if any. Defaults to "us-east-1".
+	AWSRegion string
+	// MemoryMiB is the amount of memory to give the VM, in MiB.
+	MemoryMiB int
+	// Accelerator selects the hardware virtualization backend to
+	// run the VM with. The zero value, AccelAuto, picks a backend
+	// appropriate for the host OS (KVM on Linux, HVF on macOS, WHPX
+	// on Windows), falling back to software emulation elsewhere.
+	Accelerator Accelerator
+	// QemuBinary overrides the qemu binary used to run the VM,
+	// e.g. "qemu-system-aarch64" to run an ARM guest. Defaults to
+	// "qemu-system-x86_64".
+	QemuBinary string
+	// CPUModel overrides the qemu "-cpu" model. Defaults to "host"
+	// when using a hardware accelerator, and "max" under software
+	// emulation.
+	CPUModel string
+	// CommandLog, if set, receives a copy of every command executed
+	// on the VM's behalf (e.g. the qemu invocation used to start it).
+	CommandLog io.Writer
+	// Networks lists the networks the VM attaches a NIC to, in
+	// order. The first entry is the VM's primary NIC, used by IPv4,
+	// IPv6 and the Universe's AddDelay/AddLoss/AddDuplication/
+	// AddPartition/Clear. Defaults to the universe's default network
+	// if empty.
+	Networks []*Network
+}
+
+const defaultQemuBinary = "qemu-system-x86_64"
+
+func (c *VMConfig) qemuBinary() string {
+	if c.QemuBinary != "" {
+		return c.QemuBinary
+	}
+	return defaultQemuBinary
+}
+
+func (c *VMConfig) cpuModel(accel Accelerator) string {
+	if c.CPUModel != "" {
+		return c.CPUModel
+	}
+	if accel == AccelTCG {
+		return "max"
+	}
+	return "host"
+}
+
+// A VM is a running virtual machine within a Universe.
+type VM struct {
+	hostname string
+	universe *Universe
+	cfg      *VMConfig
+
+	cmd *exec.Cmd
+
+	monitorSock string
+	diskPath    string
+
+	nics []vmNIC
+}
+
+// A vmNIC is one of a VM's network attachments.
+type vmNIC struct {
+	network *Network
+	tapName string
+	tapShim *exec.Cmd
+	mac     net.HardwareAddr
+	ip4     net.IP
+	ip6     net.IP
+
+	netem netemState
+}
+
+// primaryNIC returns the VM's first network attachment, which
+// single-homed convenience methods (IPv4, IPv6, and the Universe's
+// AddDelay/AddLoss/AddDuplication/AddPartition/Clear) act on.
+func (v *VM) primaryNIC() *vmNIC {
+	return &v.nics[0]
+}
+
+// IPv4 returns the VM's IPv4 address on its primary network.
+func (v *VM) IPv4() net.IP {
+	return v.primaryNIC().ip4
+}
+
+// IPv6 returns the VM's IPv6 address on its primary network.
+func (v *VM) IPv6() net.IP {
+	return v.primaryNIC().ip6
+}
+
+// NewVM creates and starts a new VM within the universe, booting from
+// a copy-on-write overlay of cfg.Image.
+func (u *Universe) NewVM(hostname string, cfg *VMConfig) (*VM, error) {
+	qemuBin := cfg.qemuBinary()
+	if err := checkTools([]string{qemuBin}); err != nil {
+		return nil, err
+	}
+
+	accel := cfg.Accelerator.resolve()
+
+	baseImage, err := u.resolveImage(cfg)
+	if err != nil {
+		return nil, err
+	}
+
+	dir, err := u.Tmpdir(hostname)
+	if err != nil {
+		return nil, err
+	}
+
+	diskPath := filepath.Join(dir, "disk.qcow2")
+	overlay := exec.Command(
+		"qemu-img", "create",
+		"-f", "qcow2",
+		"-b", baseImage,
+		diskPath,
+	)
+	if out, err := overlay.CombinedOutput(); err != nil {
+		return nil, fmt.Errorf("creating disk overlay for %s: %v: %s", hostname, err, out)
+	}
+
+	monitorSock := filepath.Join(dir, "monitor.sock")
+
+	networks := cfg.Networks
+	if len(networks) == 0 {
+		networks = []*Network{u.defaultNetwork}
+	}
+
+	nics := make([]vmNIC, len(networks))
+	args := []string{
+		"-m", strconv.Itoa(cfg.MemoryMiB),
+		"-accel", accel.String(),
+		"-cpu", cfg.cpuModel(accel),
+		"-qmp", "unix:" + monitorSock + ",server,nowait",
+		"-drive", "file=" + diskPath + ",if=virtio",
+		"-nographic",
+	}
+	for i, network := range networks {
+		mac := generateMAC(network.name, hostname)
+		tapName, shim, err := network.newTapShim(hostname)
+		if err != nil {
+			for _, nic := range nics[:i] {
+				nic.tapShim.Process.Kill()
+			}
+			return nil, err
+		}
+
+		ip4, err := network.ipv4()
+		if err != nil {
+			shim.Process.Kill()
+			for _, nic := range nics[:i] {
+				nic.tapShim.Process.Kill()
+			}
+			return nil, err
+		}
+		ip6, err := network.ipv6()
+		if err != nil {
+			shim.Process.Kill()
+			for _, nic := range nics[:i] {
+				nic.tapShim.Process.Kill()
+			}
+			return nil, err
+		}
+
+		netID := fmt.Sprintf("net%d", i)
+		args = append(args,
+			"-netdev", "tap,id="+netID+",ifname="+tapName+",script=no,downscript=no",
+			"-device", "virtio-net,netdev="+netID+",mac="+mac.String(),
+		)
+
+		nics[i] = vmNIC{
+			network: network,
+			tapName: tapName,
+			tapShim: shim,
+			mac:     mac,
+			ip4:     ip4,
+			ip6:     ip6,
+		}
+	}
+
+	cmd := exec.CommandContext(u.ctx, qemuBin, args...)
+	if cfg.CommandLog != nil {
+		fmt.Fprintln(cfg.CommandLog, cmd.Args)
+		cmd.Stdout = cfg.CommandLog
+		cmd.Stderr = cfg.CommandLog
+	}
+
+	if err := cmd.Start(); err != nil {
+		return nil, fmt.Errorf("starting %s: %v", hostname, err)
+	}
+
+	vm := &VM{
+		hostname:    hostname,
+		universe:    u,
+		cfg:         cfg,
+		cmd:         cmd,
+		monitorSock: monitorSock,
+		diskPath:    diskPath,
+		nics:        nics,
+	}
+	u.vms[hostname] = vm
+
+	return vm, nil
+}
+
+// Hostname returns the VM's hostname.
+func (v *VM) Hostname() string {
+	return v.hostname
+}
+
+// Monitor opens a fresh QMP connection to the VM, for pausing,
+// resuming, hot-plugging devices, and other control-plane operations.
+// Callers must Close() the returned Monitor when done with it.
+func (v *VM) Monitor() (*Monitor, error) {
+	conn, err := dialQMP(v.monitorSock)
+	if err != nil {
+		return nil, err
+	}
+	return &Monitor{conn: conn}, nil
+}
+
+// Pause stops the VM. It can be resumed with Resume.
+func (v *VM) Pause() error {
+	mon, err := v.Monitor()
+	if err != nil {
+		return err
+	}
+	defer mon.Close()
+	return mon.Pause()
+}
+
+// Resume continues a VM previously paused with Pause.
+func (v *VM) Resume() error {
+	mon, err := v.Monitor()
+	if err != nil {
+		return err
+	}
+	defer mon.Close()
+	return mon.Resume()
+}
+
+// Reset performs a hard reset of the VM.
+func (v *VM) Reset() error {
+	mon, err := v.Monitor()
+	if err != nil {
+		return err
+	}
+	defer mon.Close()
+	return mon.Reset()
+}
+
+// HotplugDisk attaches a new qcow2 disk image at path to the running
+// VM.
+func (v *VM) HotplugDisk(driveID, path string) error {
+	mon, err := v.Monitor()
+	if err != nil {
+		return err
+	}
+	defer mon.Close()
+	return mon.HotplugDisk(driveID, path)
+}
+
+// HotplugNIC attaches a new virtio NIC to the VM, connected to
+// network (the VM's primary network if nil) and identified by netID.
+// Like every NIC created by NewVM, it's bridged through its own tap
+// shim rather than attached straight to the vde switch, is added to
+// the VM's NIC list, and gets IPv4 and IPv6 addresses from network;
+// the IPv4 address is returned. IPv4, IPv6 and
+// AddDelay/AddLoss/AddDuplication/AddPartition/Clear act on the
+// primary NIC only, never on a hotplugged one.
+func (v *VM) HotplugNIC(netID string, network *Network) (net.IP, error) {
+	if network == nil {
+		network = v.primaryNIC().network
+	}
+
+	tapName, shim, err := network.newTapShim(v.hostname + "-" + netID)
+	if err != nil {
+		return nil, err
+	}
+
+	mac := generateMAC(network.name, v.hostname+"/"+netID)
+
+	ip4, err := network.ipv4()
+	if err != nil {
+		shim.Process.Kill()
+		return nil, err
+	}
+	ip6, err := network.ipv6()
+	if err != nil {
+		shim.Process.Kill()
+		return nil, err
+	}
+
+	mon, err := v.Monitor()
+	if err != nil {
+		shim.Process.Kill()
+		return nil, err
+	}
+	defer mon.Close()
+
+	if err := mon.HotplugNIC(netID, tapName, mac); err != nil {
+		shim.Process.Kill()
+		return nil, err
+	}
+
+	v.nics = append(v.nics, vmNIC{
+		network: network,
+		tapName: tapName,
+		tapShim: shim,
+		mac:     mac,
+		ip4:     ip4,
+		ip6:     ip6,
+	})
+
+	return ip4, nil
+}
+
+// Screendump writes a PPM screenshot of the VM's display to path.
+func (v *VM) Screendump(path string) error {
+	mon, err := v.Monitor()
+	if err != nil {
+		return err
+	}
+	defer mon.Close()
+	return mon.Screendump(path)
+}